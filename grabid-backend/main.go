@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
@@ -13,18 +15,27 @@ import (
 	"sync"
 	"time"
 
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"golang.org/x/time/rate"
 )
 
 // Config holds the application configuration
 type Config struct {
-	Port          string
-	GrabSecret    string
-	MaxSize       int64
-	MaxSizeStr    string
-	MaxConcurrent int
-	RateLimit     rate.Limit
-	RateBurst     int
+	Port           string
+	GrabSecret     string
+	MaxSize        int64
+	MaxSizeStr     string
+	MaxConcurrent  int
+	RateLimit      rate.Limit
+	RateBurst      int
+	TrustedProxies []*net.IPNet
+	TLSCertFile    string
+	TLSKeyFile     string
+	H2C            bool
+	StreamTimeout  time.Duration
+	MetricsToken   string
+	MetricsAddr    string
 }
 
 // ParseSize parses a size string (e.g., "1GB", "500MB") into bytes.
@@ -69,6 +80,32 @@ func ParseRateLimit(rateStr string) (rate.Limit, int) {
 	return rate.Limit(r), b
 }
 
+// ParseTrustedProxies parses a comma-separated list of CIDRs (or bare IPs,
+// treated as a /32 or /128) into the networks RateLimitMiddleware should
+// treat as trusted intermediaries when reading forwarded-for headers.
+func ParseTrustedProxies(cidrList string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, part := range strings.Split(cidrList, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			if ip := net.ParseIP(part); ip != nil {
+				if ip.To4() != nil {
+					part += "/32"
+				} else {
+					part += "/128"
+				}
+			}
+		}
+		if _, n, err := net.ParseCIDR(part); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
 // LoadConfig loads configuration from environment variables
 func LoadConfig() Config {
 	port := os.Getenv("PORT")
@@ -92,14 +129,28 @@ func LoadConfig() Config {
 	}
 	r, b := ParseRateLimit(rateLimitStr)
 
+	streamTimeout := 30 * time.Minute
+	if v := os.Getenv("GRAB_STREAM_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			streamTimeout = d
+		}
+	}
+
 	return Config{
-		Port:          port,
-		GrabSecret:    os.Getenv("GRAB_SECRET"),
-		MaxSize:       ParseSize(maxSizeStr),
-		MaxSizeStr:    maxSizeStr,
-		MaxConcurrent: maxConcurrent,
-		RateLimit:     r,
-		RateBurst:     b,
+		Port:           port,
+		GrabSecret:     os.Getenv("GRAB_SECRET"),
+		MaxSize:        ParseSize(maxSizeStr),
+		MaxSizeStr:     maxSizeStr,
+		MaxConcurrent:  maxConcurrent,
+		RateLimit:      r,
+		RateBurst:      b,
+		TrustedProxies: ParseTrustedProxies(os.Getenv("GRAB_TRUSTED_PROXIES")),
+		TLSCertFile:    os.Getenv("GRAB_TLS_CERT"),
+		TLSKeyFile:     os.Getenv("GRAB_TLS_KEY"),
+		H2C:            os.Getenv("GRAB_H2C") == "1",
+		StreamTimeout:  streamTimeout,
+		MetricsToken:   os.Getenv("GRAB_METRICS_TOKEN"),
+		MetricsAddr:    os.Getenv("GRAB_METRICS_ADDR"),
 	}
 }
 
@@ -190,22 +241,12 @@ func (i *IPRateLimiter) Cleanup() {
 }
 
 // RateLimitMiddleware enforces rate limits per IP
-func RateLimitMiddleware(next http.HandlerFunc, limiter *IPRateLimiter) http.HandlerFunc {
+func RateLimitMiddleware(next http.HandlerFunc, limiter *IPRateLimiter, trustedProxies []*net.IPNet, metrics *Metrics) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ip := r.RemoteAddr
-		// Handle X-Forwarded-For if behind proxy
-		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
-			ip = forwarded
-		}
-		// Remove port
-		if strings.Contains(ip, ":") {
-			host, _, err := net.SplitHostPort(ip)
-			if err == nil {
-				ip = host
-			}
-		}
+		ip := clientIP(r, trustedProxies)
 
 		if !limiter.GetLimiter(ip).Allow() {
+			metrics.RateLimitRejectsTotal.Inc()
 			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
 			return
 		}
@@ -213,8 +254,110 @@ func RateLimitMiddleware(next http.HandlerFunc, limiter *IPRateLimiter) http.Han
 	}
 }
 
+// clientIP determines the real client address for r, trusting
+// forwarded-for headers only insofar as they were added by a proxy in
+// trustedProxies. If trustedProxies is empty, or the peer that connected to
+// us isn't in it, forwarded headers are attacker-controllable and are
+// ignored entirely in favor of the raw TCP source address.
+func clientIP(r *http.Request, trustedProxies []*net.IPNet) string {
+	remoteIP := stripPort(r.RemoteAddr)
+
+	if len(trustedProxies) == 0 || !ipInNets(remoteIP, trustedProxies) {
+		return remoteIP
+	}
+
+	hops := forwardedHops(r)
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !ipInNets(hops[i], trustedProxies) {
+			return hops[i]
+		}
+	}
+	if len(hops) > 0 {
+		// Every hop is itself a trusted proxy; the left-most entry is the
+		// best guess we have at the original client.
+		return hops[0]
+	}
+
+	return remoteIP
+}
+
+// forwardedHops extracts the chain of client addresses from the RFC 7239
+// Forwarded header if present, otherwise from X-Forwarded-For, in the order
+// they were appended (oldest/left-most first).
+func forwardedHops(r *http.Request) []string {
+	if forwarded := r.Header.Get("Forwarded"); forwarded != "" {
+		var hops []string
+		for _, part := range strings.Split(forwarded, ",") {
+			for _, directive := range strings.Split(part, ";") {
+				directive = strings.TrimSpace(directive)
+				if len(directive) < 4 || !strings.EqualFold(directive[:4], "for=") {
+					continue
+				}
+				if hop := parseForwardedFor(directive[4:]); hop != "" {
+					hops = append(hops, hop)
+				}
+			}
+		}
+		if len(hops) > 0 {
+			return hops
+		}
+	}
+
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		var hops []string
+		for _, part := range strings.Split(xff, ",") {
+			if hop := stripPort(strings.Trim(strings.TrimSpace(part), "[]")); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+		return hops
+	}
+
+	return nil
+}
+
+// parseForwardedFor extracts the address from a single RFC 7239 for=
+// directive value (the text after "for="). Quoted IPv6 values carry their
+// own bracket+port syntax, e.g. for="[2001:db8::1]:4711" -- a plain
+// strings.Trim(s, `"[]`) only trims runes off the two ends, so it strips
+// the leading quote and bracket but leaves the trailing "]" stuck to the
+// address. Trim the quotes first, then match the brackets as a pair
+// before falling back to stripPort for the unbracketed IPv4 case.
+func parseForwardedFor(value string) string {
+	value = strings.Trim(value, `"`)
+	if strings.HasPrefix(value, "[") {
+		if end := strings.IndexByte(value, ']'); end != -1 {
+			return value[1:end]
+		}
+	}
+	return stripPort(value)
+}
+
+// stripPort removes a trailing ":port" from a host[:port] string, including
+// bracketed IPv6 addresses. If it has no port, the input is returned with
+// any surrounding "[" and "]" trimmed.
+func stripPort(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return strings.Trim(hostport, "[]")
+}
+
+func ipInNets(ipStr string, nets []*net.IPNet) bool {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // handleProbe handles the HEAD /api/v1/probe endpoint
-func handleProbe(w http.ResponseWriter, r *http.Request) {
+func handleProbe(w http.ResponseWriter, r *http.Request, cfg Config, validator *URLValidator, metrics *Metrics, logger *slog.Logger) {
 	if r.Method != http.MethodHead && r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -226,23 +369,59 @@ func handleProbe(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create a HEAD request to the source
-	req, err := http.NewRequest(http.MethodHead, urlParam, nil)
+	pinnedIP, err := validator.Validate(r.Context(), urlParam)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("URL rejected: %v", err), http.StatusForbidden)
+		return
+	}
+
+	// Create a HEAD request to the source, tied to the inbound request's
+	// context so a client disconnect aborts it too.
+	req, err := http.NewRequestWithContext(withPinnedIP(r.Context(), pinnedIP), http.MethodHead, urlParam, nil)
 	if err != nil {
 		http.Error(w, "Invalid URL", http.StatusBadRequest)
 		return
 	}
 
 	client := &http.Client{
-		Timeout: 10 * time.Second,
+		Timeout:   10 * time.Second,
+		Transport: validator.transport(),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
 	}
+	upstreamStart := time.Now()
 	resp, err := client.Do(req)
+	metrics.UpstreamDuration.WithLabelValues("probe").Observe(time.Since(upstreamStart).Seconds())
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to reach source: %v", err), http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
 
+	logger.Info("request",
+		"method", r.Method,
+		"path", r.URL.Path,
+		"remote_ip", clientIP(r, cfg.TrustedProxies),
+		"upstream_host", req.URL.Host,
+		"upstream_status", resp.StatusCode,
+		"bytes", resp.ContentLength,
+		"duration_ms", time.Since(upstreamStart).Milliseconds(),
+	)
+
+	// The pinned IP only ever covers the host that was validated above, so
+	// we don't let the client auto-follow a redirect to a different host
+	// (it would dial that host's port against this host's pinned IP). Pass
+	// the redirect straight through instead and let the caller decide
+	// whether to re-request it.
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		if loc := resp.Header.Get("Location"); loc != "" {
+			w.Header().Set("Location", loc)
+		}
+		w.WriteHeader(resp.StatusCode)
+		return
+	}
+
 	if resp.StatusCode >= 400 {
 		http.Error(w, fmt.Sprintf("Source returned error: %d", resp.StatusCode), http.StatusBadGateway)
 		return
@@ -261,7 +440,7 @@ func handleProbe(w http.ResponseWriter, r *http.Request) {
 }
 
 // handleStream handles the GET /api/v1/stream endpoint
-func handleStream(w http.ResponseWriter, r *http.Request, cfg Config, sem chan struct{}) {
+func handleStream(w http.ResponseWriter, r *http.Request, cfg Config, sem chan struct{}, validator *URLValidator, metrics *Metrics, logger *slog.Logger) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -272,6 +451,7 @@ func handleStream(w http.ResponseWriter, r *http.Request, cfg Config, sem chan s
 	case sem <- struct{}{}:
 		defer func() { <-sem }()
 	default:
+		metrics.ConcurrencyRejectsTotal.Inc()
 		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
 		return
 	}
@@ -282,29 +462,87 @@ func handleStream(w http.ResponseWriter, r *http.Request, cfg Config, sem chan s
 		return
 	}
 
+	// We don't compose multipart/byteranges bodies, so multi-range requests
+	// (e.g. "bytes=0-10,20-30") are rejected outright.
+	rangeHeader := r.Header.Get("Range")
+	if strings.Contains(rangeHeader, ",") {
+		http.Error(w, "Multi-range requests are not supported", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	// Bound the whole fetch so a client that vanishes mid-download, or a
+	// source that trickles data forever, doesn't hold the concurrency slot
+	// and egress open indefinitely.
+	ctx, cancel := context.WithTimeout(r.Context(), cfg.StreamTimeout)
+	defer cancel()
+
+	pinnedIP, err := validator.Validate(ctx, urlParam)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("URL rejected: %v", err), http.StatusForbidden)
+		return
+	}
+
 	// Create a GET request to the source
-	req, err := http.NewRequest(http.MethodGet, urlParam, nil)
+	req, err := http.NewRequestWithContext(withPinnedIP(ctx, pinnedIP), http.MethodGet, urlParam, nil)
 	if err != nil {
 		http.Error(w, "Invalid URL", http.StatusBadRequest)
 		return
 	}
 
-	client := &http.Client{}
+	// Forward range/conditional headers so clients can resume downloads and
+	// seek. If the source doesn't support ranges it will just respond with a
+	// full 200, which we pass through unchanged below.
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" {
+		req.Header.Set("If-Range", ifRange)
+	}
+	if ifModifiedSince := r.Header.Get("If-Modified-Since"); ifModifiedSince != "" {
+		req.Header.Set("If-Modified-Since", ifModifiedSince)
+	}
+
+	client := &http.Client{
+		Transport: validator.transport(),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
 
+	start := time.Now()
 	resp, err := client.Do(req)
+	metrics.UpstreamDuration.WithLabelValues("stream").Observe(time.Since(start).Seconds())
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to reach source: %v", err), http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
 
+	// Same reasoning as handleProbe: the pinned IP only covers the
+	// validated host, so a cross-host redirect can't be auto-followed
+	// through the shared transport. Pass it through to the caller instead.
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		if loc := resp.Header.Get("Location"); loc != "" {
+			w.Header().Set("Location", loc)
+		}
+		w.WriteHeader(resp.StatusCode)
+		return
+	}
+
 	if resp.StatusCode >= 400 {
 		http.Error(w, fmt.Sprintf("Source returned error: %d", resp.StatusCode), http.StatusBadGateway)
 		return
 	}
 
-	// Size Check (Header)
-	if resp.ContentLength > cfg.MaxSize {
+	// Size Check: for a 206, the size that matters is the range being
+	// served, not the Content-Length of the full object.
+	effectiveSize := resp.ContentLength
+	if resp.StatusCode == http.StatusPartialContent {
+		if rangeLen, ok := parseContentRangeLength(resp.Header.Get("Content-Range")); ok {
+			effectiveSize = rangeLen
+		}
+	}
+	if effectiveSize > cfg.MaxSize {
 		http.Error(w, "Payload Too Large", http.StatusRequestEntityTooLarge)
 		return
 	}
@@ -328,14 +566,89 @@ func handleStream(w http.ResponseWriter, r *http.Request, cfg Config, sem chan s
 		}
 	}
 
-	// Streamer Engine with LimitReader
+	if resp.StatusCode == http.StatusPartialContent {
+		if contentRange := resp.Header.Get("Content-Range"); contentRange != "" {
+			w.Header().Set("Content-Range", contentRange)
+		}
+		if acceptRanges := resp.Header.Get("Accept-Ranges"); acceptRanges != "" {
+			w.Header().Set("Accept-Ranges", acceptRanges)
+		}
+		if etag := resp.Header.Get("ETag"); etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" {
+			w.Header().Set("Last-Modified", lastModified)
+		}
+		w.WriteHeader(http.StatusPartialContent)
+	}
+
+	// Streamer Engine with LimitReader. We copy in small chunks and check
+	// ctx between each one instead of a single io.Copy, so a client
+	// disconnect or the stream deadline is noticed promptly even while the
+	// source is a slow trickle, rather than only after io.Copy's next read
+	// happens to return.
 	limitedBody := io.LimitReader(resp.Body, cfg.MaxSize)
-	_, err = io.Copy(w, limitedBody)
-	if err != nil {
-		// If io.Copy fails, it might be due to limit reached or connection error.
-		// We can't really change status code here.
-		log.Printf("Error streaming data: %v", err)
+	buf := make([]byte, 32*1024)
+	var bytesCopied int64
+	for {
+		if err := ctx.Err(); err != nil {
+			log.Printf("Stream canceled: %v", err)
+			break
+		}
+
+		n, readErr := limitedBody.Read(buf)
+		if n > 0 {
+			if _, writeErr := w.Write(buf[:n]); writeErr != nil {
+				log.Printf("Error writing to client: %v", writeErr)
+				break
+			}
+			bytesCopied += int64(n)
+			metrics.StreamBytesTotal.Add(float64(n))
+		}
+		if readErr != nil {
+			// If the read fails, it might be due to the limit being
+			// reached, the source closing, or cancellation.
+			// We can't really change status code here.
+			if readErr != io.EOF {
+				log.Printf("Error streaming data: %v", readErr)
+			}
+			break
+		}
+	}
+
+	logger.Info("request",
+		"method", r.Method,
+		"path", r.URL.Path,
+		"remote_ip", clientIP(r, cfg.TrustedProxies),
+		"upstream_host", req.URL.Host,
+		"upstream_status", resp.StatusCode,
+		"bytes", bytesCopied,
+		"duration_ms", time.Since(start).Milliseconds(),
+	)
+}
+
+// parseContentRangeLength extracts the number of bytes covered by a
+// "Content-Range: bytes start-end/total" header value.
+func parseContentRangeLength(headerVal string) (int64, bool) {
+	if !strings.HasPrefix(headerVal, "bytes ") {
+		return 0, false
+	}
+	spec := strings.TrimPrefix(headerVal, "bytes ")
+	slashIdx := strings.Index(spec, "/")
+	if slashIdx == -1 {
+		return 0, false
+	}
+	byteRange := spec[:slashIdx]
+	dashIdx := strings.Index(byteRange, "-")
+	if dashIdx == -1 {
+		return 0, false
+	}
+	start, err1 := strconv.ParseInt(byteRange[:dashIdx], 10, 64)
+	end, err2 := strconv.ParseInt(byteRange[dashIdx+1:], 10, 64)
+	if err1 != nil || err2 != nil || end < start {
+		return 0, false
 	}
+	return end - start + 1, true
 }
 
 func main() {
@@ -347,24 +660,49 @@ func main() {
 	// Initialize Rate Limiter
 	ipLimiter := NewIPRateLimiter(cfg.RateLimit, cfg.RateBurst)
 
+	// Initialize SSRF guardrails shared by the probe and stream endpoints
+	urlValidator := NewURLValidator()
+
+	// Initialize metrics and structured request logging
+	metrics := NewMetrics(concurrencySem)
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
 	mux := http.NewServeMux()
 
 	// Register endpoints with Auth Middleware
-	mux.HandleFunc("/api/v1/probe", AuthMiddleware(handleProbe, cfg.GrabSecret))
-	
+	mux.HandleFunc("/api/v1/probe", instrumentedHandler("probe", metrics, AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		handleProbe(w, r, cfg, urlValidator, metrics, logger)
+	}, cfg.GrabSecret)))
+
 	// Stream handler with Rate Limit and Concurrency Control
-	mux.HandleFunc("/api/v1/stream", AuthMiddleware(RateLimitMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		handleStream(w, r, cfg, concurrencySem)
-	}, ipLimiter), cfg.GrabSecret))
+	mux.HandleFunc("/api/v1/stream", instrumentedHandler("stream", metrics, AuthMiddleware(RateLimitMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		handleStream(w, r, cfg, concurrencySem, urlValidator, metrics, logger)
+	}, ipLimiter, cfg.TrustedProxies, metrics), cfg.GrabSecret)))
 
-	mux.HandleFunc("/api/v1/info", AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/api/v1/info", instrumentedHandler("info", metrics, AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		resp := InfoResponse{
 			MaxSizeStr:    cfg.MaxSizeStr,
 			MaxConcurrent: cfg.MaxConcurrent,
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(resp)
-	}, cfg.GrabSecret))
+	}, cfg.GrabSecret)))
+
+	// Expose /metrics on the main mux behind GRAB_METRICS_TOKEN, unless
+	// GRAB_METRICS_ADDR asks us to isolate it on its own listener instead
+	// (e.g. a private address a reverse proxy won't forward to).
+	if cfg.MetricsAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", metricsHandler(metrics))
+		go func() {
+			log.Printf("Serving metrics on %s", cfg.MetricsAddr)
+			if err := http.ListenAndServe(cfg.MetricsAddr, metricsMux); err != nil {
+				log.Printf("Metrics server stopped: %v", err)
+			}
+		}()
+	} else {
+		mux.Handle("/metrics", metricsAuthMiddleware(metricsHandler(metrics), cfg.MetricsToken))
+	}
 
 	log.Printf("Starting grabid-backend on port %s", cfg.Port)
 	if cfg.GrabSecret == "" {
@@ -373,9 +711,28 @@ func main() {
 		log.Println("Running in SECURE mode (authentication enabled)")
 	}
 
+	// Cleartext HTTP/2 for clients behind an already-TLS-terminating reverse
+	// proxy. Only relevant when we're not terminating TLS ourselves below.
+	var handler http.Handler = mux
+	if cfg.TLSCertFile == "" && cfg.TLSKeyFile == "" && cfg.H2C {
+		handler = h2c.NewHandler(mux, &http2.Server{})
+		log.Println("HTTP/2 enabled via h2c (cleartext)")
+	}
+
 	server := &http.Server{
 		Addr:    ":" + cfg.Port,
-		Handler: mux,
+		Handler: handler,
+	}
+
+	if cfg.TLSCertFile != "" && cfg.TLSKeyFile != "" {
+		if err := http2.ConfigureServer(server, &http2.Server{}); err != nil {
+			log.Fatalf("Failed to configure HTTP/2: %v", err)
+		}
+		log.Println("HTTP/2 enabled via TLS (ALPN)")
+		if err := server.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
+			log.Fatalf("Server failed to start: %v", err)
+		}
+		return
 	}
 
 	if err := server.ListenAndServe(); err != nil {
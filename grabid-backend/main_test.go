@@ -1,13 +1,23 @@
 package main
 
 import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/time/rate"
 )
 
+// discardLogger is the *slog.Logger used by tests that don't care about the
+// structured request log grabid-backend emits per request.
+var discardLogger = slog.New(slog.NewJSONHandler(io.Discard, nil))
+
 func TestAuthMiddleware(t *testing.T) {
 	// Mock handler
 	nextHandler := func(w http.ResponseWriter, r *http.Request) {
@@ -89,6 +99,182 @@ func TestParseSize(t *testing.T) {
 	}
 }
 
+func TestHandleStreamRangePassthrough(t *testing.T) {
+	const body = "0123456789abcdefghijklmnopqrstuvwxyz"
+	modTime := time.Unix(1700000000, 0)
+
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "source.bin", modTime, strings.NewReader(body))
+	}))
+	defer source.Close()
+
+	cfg := Config{MaxSize: int64(len(body)), StreamTimeout: 5 * time.Second}
+	sem := make(chan struct{}, 1)
+	validator := &URLValidator{AllowedSchemes: []string{"http", "https"}}
+	metrics := NewMetrics(sem)
+
+	doStream := func(rangeHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/stream?url="+source.URL, nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		w := httptest.NewRecorder()
+		handleStream(w, req, cfg, sem, validator, metrics, discardLogger)
+		return w
+	}
+
+	t.Run("unbounded range", func(t *testing.T) {
+		w := doStream("bytes=5-")
+		if w.Code != http.StatusPartialContent {
+			t.Fatalf("expected 206, got %d", w.Code)
+		}
+		if got := w.Body.String(); got != body[5:] {
+			t.Errorf("unexpected body: %q", got)
+		}
+		if cr := w.Header().Get("Content-Range"); cr == "" {
+			t.Error("expected Content-Range header to be set")
+		}
+	})
+
+	t.Run("suffix range", func(t *testing.T) {
+		w := doStream("bytes=-5")
+		if w.Code != http.StatusPartialContent {
+			t.Fatalf("expected 206, got %d", w.Code)
+		}
+		if got := w.Body.String(); got != body[len(body)-5:] {
+			t.Errorf("unexpected body: %q", got)
+		}
+	})
+
+	t.Run("multi-range rejected", func(t *testing.T) {
+		w := doStream("bytes=0-5,10-15")
+		if w.Code != http.StatusRequestedRangeNotSatisfiable {
+			t.Fatalf("expected 416, got %d", w.Code)
+		}
+	})
+}
+
+func TestHandleStreamContextCancellation(t *testing.T) {
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Slow trickle: write a few bytes, flush, then hang until the
+		// client goes away.
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer source.Close()
+
+	cfg := Config{MaxSize: 1024, StreamTimeout: 5 * time.Second}
+	sem := make(chan struct{}, 1)
+	validator := &URLValidator{AllowedSchemes: []string{"http", "https"}}
+	metrics := NewMetrics(sem)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/stream?url="+source.URL, nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		handleStream(w, req, cfg, sem, validator, metrics, discardLogger)
+		close(done)
+	}()
+
+	// Give the handler time to start streaming before simulating a client
+	// disconnect.
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handleStream did not return promptly after cancellation")
+	}
+
+	select {
+	case sem <- struct{}{}:
+	default:
+		t.Error("semaphore slot was not released after cancellation")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trustedProxies := ParseTrustedProxies("10.0.0.0/8")
+
+	tests := []struct {
+		name           string
+		remoteAddr     string
+		xff            string
+		forwarded      string
+		trustedProxies []*net.IPNet
+		expected       string
+	}{
+		{
+			name:       "no trusted proxies configured uses RemoteAddr",
+			remoteAddr: "203.0.113.7:51234",
+			xff:        "1.2.3.4",
+			expected:   "203.0.113.7",
+		},
+		{
+			name:           "spoofed XFF from untrusted peer is ignored",
+			remoteAddr:     "203.0.113.7:51234",
+			xff:            "1.2.3.4",
+			trustedProxies: trustedProxies,
+			expected:       "203.0.113.7",
+		},
+		{
+			name:           "chained proxies returns first untrusted hop",
+			remoteAddr:     "10.0.0.5:443",
+			xff:            "198.51.100.9, 10.0.0.2, 10.0.0.5",
+			trustedProxies: trustedProxies,
+			expected:       "198.51.100.9",
+		},
+		{
+			name:           "all hops trusted falls back to left-most",
+			remoteAddr:     "10.0.0.5:443",
+			xff:            "10.0.0.1, 10.0.0.2",
+			trustedProxies: trustedProxies,
+			expected:       "10.0.0.1",
+		},
+		{
+			name:           "RFC 7239 Forwarded header is honored",
+			remoteAddr:     "10.0.0.5:443",
+			forwarded:      `for=198.51.100.9;proto=https, for=10.0.0.2`,
+			trustedProxies: trustedProxies,
+			expected:       "198.51.100.9",
+		},
+		{
+			name:           "RFC 7239 Forwarded header with quoted bracketed IPv6",
+			remoteAddr:     "10.0.0.5:443",
+			forwarded:      `for="[2001:db8::1]:4711";proto=https, for=10.0.0.2`,
+			trustedProxies: trustedProxies,
+			expected:       "2001:db8::1",
+		},
+		{
+			name:       "IPv6 RemoteAddr with port",
+			remoteAddr: "[2001:db8::1]:443",
+			expected:   "2001:db8::1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if tt.forwarded != "" {
+				req.Header.Set("Forwarded", tt.forwarded)
+			}
+
+			got := clientIP(req, tt.trustedProxies)
+			if got != tt.expected {
+				t.Errorf("clientIP() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
 func TestParseRateLimit(t *testing.T) {
 	tests := []struct {
 		input         string
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestInstrumentedHandlerRecordsStatus(t *testing.T) {
+	sem := make(chan struct{}, 1)
+	metrics := NewMetrics(sem)
+
+	handler := instrumentedHandler("probe", metrics, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusForbidden)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/probe", nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", w.Code)
+	}
+	if got := testutilCounterValue(t, metrics, "probe", "403"); got != 1 {
+		t.Errorf("grabid_requests_total{endpoint=probe,status=403} = %v, want 1", got)
+	}
+}
+
+func TestMetricsAuthMiddleware(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name           string
+		token          string
+		headerValue    string
+		expectedStatus int
+	}{
+		{name: "no token configured allows any request", token: "", headerValue: "", expectedStatus: http.StatusOK},
+		{name: "correct token", token: "s3cr3t", headerValue: "s3cr3t", expectedStatus: http.StatusOK},
+		{name: "missing token", token: "s3cr3t", headerValue: "", expectedStatus: http.StatusUnauthorized},
+		{name: "wrong token", token: "s3cr3t", headerValue: "wrong", expectedStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.headerValue != "" {
+				req.Header.Set("X-Metrics-Token", tt.headerValue)
+			}
+			w := httptest.NewRecorder()
+			metricsAuthMiddleware(next, tt.token).ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+		})
+	}
+}
+
+// testutilCounterValue scrapes metrics' registry and pulls out the sample
+// count for grabid_requests_total{endpoint=...,status=...}, avoiding a
+// dependency on prometheus/client_golang/prometheus/testutil for one
+// assertion.
+func testutilCounterValue(t *testing.T, m *Metrics, endpoint, status string) float64 {
+	t.Helper()
+	w := httptest.NewRecorder()
+	metricsHandler(m).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	needle := `grabid_requests_total{endpoint="` + endpoint + `",status="` + status + `"} `
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(line, needle) {
+			value, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimPrefix(line, needle)), 64)
+			if err != nil {
+				t.Fatalf("parsing metric line %q: %v", line, err)
+			}
+			return value
+		}
+	}
+	t.Fatalf("metric %s not found in scrape output", needle)
+	return 0
+}